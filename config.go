@@ -9,6 +9,8 @@ import (
 	"os"
 	"regexp"
 	"strings"
+	"syscall"
+	"time"
 )
 
 // jsonConf defines the format in which gomon.json file should be parsed
@@ -16,6 +18,48 @@ type jsonConf struct {
 	Watch   []string            `json:"watch"`
 	Exclude map[string][]string `json:"exclude"`
 	Cmd     string              `json:"cmd"`
+	// Blocks is the modd-style alternative to Cmd: each block declares
+	// its own watch glob plus its own prep/daemon commands. When Blocks
+	// is non-empty it takes priority over Cmd.
+	Blocks []blockConf `json:"blocks"`
+	// KillSignal is the signal sent to a daemon's process group when it
+	// needs to be stopped. One of "SIGINT", "SIGTERM" or "SIGHUP".
+	// Defaults to "SIGTERM".
+	KillSignal string `json:"killSignal"`
+	// KillTimeout is how long, in milliseconds, to wait after KillSignal
+	// before escalating to SIGKILL. Defaults to 5000.
+	KillTimeout int `json:"killTimeout"`
+	// Debounce is how long, in milliseconds, to wait for a burst of file
+	// changes to go quiet before dispatching a job. Defaults to 300.
+	Debounce int `json:"debounce"`
+}
+
+// execConf bundles the settings that control how commands are started
+// and how their output is handled, as opposed to watcherConf which
+// controls what's watched.
+type execConf struct {
+	KillSignal  syscall.Signal
+	KillTimeout time.Duration
+	// Serve is the "host:port" to serve the live-reload websocket on, or
+	// "" to disable it.
+	Serve string
+	// LogPath, if non-empty, mirrors every command's output to this file
+	// in addition to stdout/stderr.
+	LogPath string
+	// Quiet suppresses a command's stdout/stderr unless it exits
+	// non-zero, in which case its buffered tail is dumped.
+	Quiet bool
+	// DebounceWindow is how long a block must go quiet before a burst of
+	// file changes for it is coalesced into a single job.
+	DebounceWindow time.Duration
+}
+
+// blockConf is a single entry of the "blocks" array in gomon.json.
+type blockConf struct {
+	ID     string   `json:"id"`
+	Watch  []string `json:"watch"`
+	Prep   []string `json:"prep"`
+	Daemon string   `json:"daemon"`
 }
 
 // watcherConf is the configuration for watcher.
@@ -25,16 +69,36 @@ type watcherConf struct {
 	Pattern       *regexp.Regexp
 }
 
-// Returns the configuration for Watcher, commands to execute, attachStdin and verbose flags.
-func get() (*watcherConf, *[]string, *bool, *bool) {
+// block is the runtime form of a blockConf: its watch glob compiled to a
+// pattern, ready to be matched against a changed file and handed to the
+// worker.
+type block struct {
+	ID        string
+	Pattern   *regexp.Regexp
+	PrepCmds  []string
+	DaemonCmd string
+	// ContinueOnPrepFailure makes runBlock run every prep command
+	// regardless of exit code instead of bailing out on the first
+	// failure. Only set for the synthesized "default" block (see
+	// defaultBlocks), to preserve the pre-blocks behavior of the flat
+	// argument/piped/"cmd" command list, which always ran every command.
+	ContinueOnPrepFailure bool
+}
+
+// Returns the configuration for Watcher, commands to execute, the
+// modd-style blocks (nil if none are configured), the execConf governing
+// how commands are run and logged, attachStdin and verbose flags.
+func get() (*watcherConf, *[]string, map[string]block, *execConf, *bool, *bool) {
 	// get returns:
 	// (1) the config (files and folders to be excluded, file extensions to be watched for)
 	// (2) the commands to be executed
-	// (3) whether stdin is to be attached to the subprocesses(created for running the commands) and
-	// (4) whether verbose output is needed
+	// (3) the blocks to be executed, keyed by block id (nil if gomon.json has none)
+	// (4) the execConf (kill signal/timeout, live-reload address, logging)
+	// (5) whether stdin is to be attached to the subprocesses(created for running the commands) and
+	// (6) whether verbose output is needed
 	// --
 	// For (2) it checks the arguments, pipe and json file in the order of priority.
-	watch, commands, attachStdin, verbose := parse()
+	watch, commands, killSignalFlag, killTimeoutFlag, debounceFlag, serve, logPath, quiet, attachStdin, verbose := parse()
 
 	// prepare patten of file extensions to watch for
 	// --
@@ -62,7 +126,15 @@ func get() (*watcherConf, *[]string, *bool, *bool) {
 	jsonConf, err := getConfFromJSON()
 	// If some error occured while reading the file, return the default cfg
 	if err != nil {
-		return &config, commands, attachStdin, verbose
+		exec := &execConf{
+			KillSignal:     resolveKillSignal(*killSignalFlag),
+			KillTimeout:    resolveKillTimeout(*killTimeoutFlag),
+			Serve:          *serve,
+			LogPath:        *logPath,
+			Quiet:          *quiet,
+			DebounceWindow: resolveDebounceWindow(*debounceFlag),
+		}
+		return &config, commands, nil, exec, attachStdin, verbose
 	}
 
 	if *verbose {
@@ -105,16 +177,114 @@ func get() (*watcherConf, *[]string, *bool, *bool) {
 		commands = &cmds
 	}
 
-	return &config, commands, attachStdin, verbose
+	blocks := buildBlocks(jsonConf)
+	if blocks != nil && *verbose {
+		fmt.Printf("[gomon] blocks read from gomon.json: %+v\n", blocks)
+	}
+
+	// More priority is given to -kill-signal/-kill-timeout. So, only if
+	// the flag is not given, fall back to the json file, then the hardcoded default.
+	killSignalStr := *killSignalFlag
+	if killSignalStr == "" {
+		killSignalStr = jsonConf.KillSignal
+	}
+	killTimeoutMs := *killTimeoutFlag
+	if killTimeoutMs == 0 {
+		killTimeoutMs = jsonConf.KillTimeout
+	}
+	debounceMs := *debounceFlag
+	if debounceMs == 0 {
+		debounceMs = jsonConf.Debounce
+	}
+
+	exec := &execConf{
+		KillSignal:     resolveKillSignal(killSignalStr),
+		KillTimeout:    resolveKillTimeout(killTimeoutMs),
+		Serve:          *serve,
+		LogPath:        *logPath,
+		Quiet:          *quiet,
+		DebounceWindow: resolveDebounceWindow(debounceMs),
+	}
+
+	return &config, commands, blocks, exec, attachStdin, verbose
+}
+
+// resolveKillSignal maps a "killSignal" string to the syscall.Signal to
+// send, defaulting to SIGTERM for anything unrecognised or empty.
+func resolveKillSignal(name string) syscall.Signal {
+	switch name {
+	case "SIGINT":
+		return syscall.SIGINT
+	case "SIGHUP":
+		return syscall.SIGHUP
+	default:
+		return syscall.SIGTERM
+	}
+}
+
+// resolveKillTimeout turns a "killTimeout" value in milliseconds into a
+// time.Duration, defaulting to 5 seconds when ms is 0.
+func resolveKillTimeout(ms int) time.Duration {
+	if ms == 0 {
+		return 5 * time.Second
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+// resolveDebounceWindow turns a "debounce" value in milliseconds into a
+// time.Duration, defaulting to 300ms when ms is 0.
+func resolveDebounceWindow(ms int) time.Duration {
+	if ms == 0 {
+		return 300 * time.Millisecond
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+// buildBlocks turns the "blocks" array of a jsonConf into the runtime
+// block map the worker operates on, keyed by block id. Returns nil if no
+// blocks are configured.
+func buildBlocks(jc *jsonConf) map[string]block {
+	if len(jc.Blocks) == 0 {
+		return nil
+	}
+
+	blocks := make(map[string]block, len(jc.Blocks))
+	for _, bc := range jc.Blocks {
+		pattern := regexp.MustCompile(`(.+\.*)$`)
+		if len(bc.Watch) > 0 {
+			pattern = createPattern(&bc.Watch)
+		}
+
+		blocks[bc.ID] = block{
+			ID:        bc.ID,
+			Pattern:   pattern,
+			PrepCmds:  bc.Prep,
+			DaemonCmd: bc.Daemon,
+		}
+	}
+
+	return blocks
 }
 
 // parse parses flags and inputs.
-func parse() (watch *[]string, commands *[]string, stdin *bool, v *bool) {
-	// commands - the commands to be excuted on file change
-	// watch 	- the file extensions to watch for. ex: ["go", "c"]
-	// stdin	- flag -stdin
-	// v		- flag -v
+func parse() (watch *[]string, commands *[]string, killSignal *string, killTimeout *int, debounce *int, serve *string, logPath *string, quiet *bool, stdin *bool, v *bool) {
+	// commands 	- the commands to be excuted on file change
+	// watch 		- the file extensions to watch for. ex: ["go", "c"]
+	// killSignal	- flag -kill-signal, empty means "use json file, else SIGTERM"
+	// killTimeout	- flag -kill-timeout (ms), 0 means "use json file, else 5000"
+	// debounce		- flag -debounce (ms), 0 means "use json file, else 300"
+	// serve		- flag -serve, e.g. ":35729" to enable the live-reload websocket server
+	// logPath		- flag -log, mirrors command output to this file when set
+	// quiet		- flag -quiet, suppresses output of commands that exit 0
+	// stdin		- flag -stdin
+	// v			- flag -v
 	w := flag.String("w", "", fmt.Sprintf("file extensions to watch for\nEx: Use '%s -w go,c' to watch for .go and .c files", os.Args[0]))
+	killSignal = flag.String("kill-signal", "", "signal sent to a daemon's process group to stop it: SIGINT, SIGTERM or SIGHUP (default SIGTERM)")
+	killTimeout = flag.Int("kill-timeout", 0, "milliseconds to wait for -kill-signal before escalating to SIGKILL (default 5000)")
+	debounce = flag.Int("debounce", 0, "milliseconds a block must go quiet before its burst of file changes is coalesced into one job (default 300)")
+	serve = flag.String("serve", "", "address to serve a live-reload websocket server on, e.g. ':35729' (disabled by default)")
+	logPath = flag.String("log", "", "mirror command output to this file")
+	quiet = flag.Bool("quiet", false, "suppress command output unless it exits non-zero, then dump the buffered tail")
 	stdin = flag.Bool("stdin", false, "attach to stdin of executing commands")
 	v = flag.Bool("v", false, "get verbose output (for debugging)")
 	flag.Parse()
@@ -132,7 +302,7 @@ func parse() (watch *[]string, commands *[]string, stdin *bool, v *bool) {
 		// if arguments are not present, check for piped input
 		stdinInf, err := os.Stdin.Stat()
 		if err != nil || stdinInf.Mode()&os.ModeCharDevice != 0 {
-			return &extnsToWatch, nil, stdin, v
+			return &extnsToWatch, nil, killSignal, killTimeout, debounce, serve, logPath, quiet, stdin, v
 		}
 
 		isPiped = true
@@ -160,7 +330,7 @@ func parse() (watch *[]string, commands *[]string, stdin *bool, v *bool) {
 		cmds = append(cmds, strings.Trim(command, " "))
 	}
 
-	return &extnsToWatch, &cmds, stdin, v
+	return &extnsToWatch, &cmds, killSignal, killTimeout, debounce, serve, logPath, quiet, stdin, v
 }
 
 func createPattern(extnsToWatch *[]string) *regexp.Regexp {
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// debouncer coalesces bursts of file-change events per block into a
+// single job, using a trailing-edge window: each new event for a block
+// resets that block's timer, and the job (carrying every distinct path
+// seen) only fires once the block has been quiet for the window.
+type debouncer struct {
+	mu      sync.Mutex
+	window  time.Duration
+	pending map[string]map[string]bool
+	timers  map[string]*time.Timer
+	jobs    chan<- job
+}
+
+// newDebouncer creates a debouncer that dispatches coalesced jobs to
+// jobs, waiting window after the last event for a block before firing.
+func newDebouncer(window time.Duration, jobs chan<- job) *debouncer {
+	return &debouncer{
+		window:  window,
+		pending: make(map[string]map[string]bool),
+		timers:  make(map[string]*time.Timer),
+		jobs:    jobs,
+	}
+}
+
+// add records that path changed for blockID and (re)schedules the
+// block's debounce timer, resetting the window.
+func (d *debouncer) add(blockID, path string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.pending[blockID] == nil {
+		d.pending[blockID] = make(map[string]bool)
+	}
+	d.pending[blockID][path] = true
+
+	if t, ok := d.timers[blockID]; ok {
+		t.Stop()
+	}
+	d.timers[blockID] = time.AfterFunc(d.window, func() { d.flush(blockID) })
+}
+
+// flush dispatches a job carrying every path buffered for blockID since
+// the last flush, then clears the buffer.
+func (d *debouncer) flush(blockID string) {
+	d.mu.Lock()
+	paths := d.pending[blockID]
+	delete(d.pending, blockID)
+	delete(d.timers, blockID)
+	d.mu.Unlock()
+
+	if len(paths) == 0 {
+		return
+	}
+
+	ps := make([]string, 0, len(paths))
+	for p := range paths {
+		ps = append(ps, p)
+	}
+	d.jobs <- job{BlockID: blockID, Paths: ps}
+}
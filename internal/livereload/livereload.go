@@ -0,0 +1,82 @@
+// Package livereload implements a tiny WebSocket broadcast server so
+// browser clients can auto-refresh whenever a watched file changes,
+// following the usual fsnotify+websocket live-reload pattern.
+package livereload
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// Event is broadcast to every connected client whenever a watched file
+// triggers a job.
+type Event struct {
+	Type string `json:"type"`
+	Path string `json:"path"`
+}
+
+// Broker fans a stream of Events out to any number of WebSocket clients.
+type Broker struct {
+	mu        sync.Mutex
+	listeners map[*websocket.Conn]struct{}
+}
+
+// NewBroker creates an empty Broker.
+func NewBroker() *Broker {
+	return &Broker{listeners: make(map[*websocket.Conn]struct{})}
+}
+
+// AddListener registers conn to receive future Publish calls.
+func (b *Broker) AddListener(conn *websocket.Conn) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.listeners[conn] = struct{}{}
+}
+
+// RemoveListener unregisters conn, e.g. once it has disconnected.
+func (b *Broker) RemoveListener(conn *websocket.Conn) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.listeners, conn)
+}
+
+// Publish sends event as JSON to every currently registered listener,
+// dropping any connection that fails to write.
+func (b *Broker) Publish(event Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for conn := range b.listeners {
+		if err := conn.WriteJSON(event); err != nil {
+			conn.Close()
+			delete(b.listeners, conn)
+		}
+	}
+}
+
+// Handler upgrades incoming HTTP requests to WebSocket connections and
+// keeps them registered with the broker until they disconnect.
+func (b *Broker) Handler() http.HandlerFunc {
+	upgrader := websocket.Upgrader{
+		CheckOrigin: func(r *http.Request) bool { return true },
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		b.AddListener(conn)
+
+		// block until the client disconnects; we don't expect it to send
+		// anything, we just need ReadMessage to notice when it's gone
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				b.RemoveListener(conn)
+				conn.Close()
+				return
+			}
+		}
+	}
+}
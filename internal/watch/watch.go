@@ -0,0 +1,154 @@
+// Package watch provides an fsnotify-backed recursive directory watcher.
+// Unlike a polling watcher, it reacts to filesystem events as they happen
+// and keeps its set of watched directories in sync with the tree: new
+// directories are added as they're created, removed ones are dropped.
+package watch
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Event is a single filesystem change detected by the Watcher.
+type Event struct {
+	Path string
+	Op   fsnotify.Op
+}
+
+// Config controls which directories the Watcher should never add a
+// watch for. Entries are treated as regular expressions matched against
+// a directory's full path, same as watcherConf.ExcludedDirs.
+type Config struct {
+	ExcludedDirs []string
+}
+
+// Watcher recursively watches a directory tree for changes, adding and
+// removing watches for subdirectories as they're created and deleted.
+type Watcher struct {
+	fsw      *fsnotify.Watcher
+	excluded []*regexp.Regexp
+	events   chan Event
+}
+
+// New creates a Watcher rooted at root and registers a watch for every
+// subdirectory that doesn't match cfg.ExcludedDirs.
+func New(root string, cfg *Config) (*Watcher, error) {
+	fsw, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create fsnotify watcher: %w", err)
+	}
+
+	w := &Watcher{
+		fsw:      fsw,
+		excluded: compileExcludes(cfg),
+		events:   make(chan Event),
+	}
+
+	if err := w.addRecursive(root); err != nil {
+		fsw.Close()
+		return nil, err
+	}
+
+	return w, nil
+}
+
+func compileExcludes(cfg *Config) []*regexp.Regexp {
+	if cfg == nil {
+		return nil
+	}
+
+	var patterns []*regexp.Regexp
+	for _, d := range cfg.ExcludedDirs {
+		if re, err := regexp.Compile(d); err == nil {
+			patterns = append(patterns, re)
+		}
+	}
+	return patterns
+}
+
+// Events returns the channel on which detected file events are
+// delivered. It must be drained concurrently with Start.
+func (w *Watcher) Events() <-chan Event {
+	return w.events
+}
+
+// Start runs the event loop, forwarding fsnotify events to Events() and
+// keeping watches in sync, until ctx is cancelled or the underlying
+// watcher errors out.
+func (w *Watcher) Start(ctx context.Context) error {
+	defer w.fsw.Close()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case ev, ok := <-w.fsw.Events:
+			if !ok {
+				return nil
+			}
+			w.handle(ev)
+		case err, ok := <-w.fsw.Errors:
+			if !ok {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// forwardedOps is the set of ops that get forwarded on the Events
+// channel, matching what the previous watcher library was filtered to
+// (Create, Write, Rename/Move) so that Chmod and Remove noise - which
+// editors and tools generate constantly - doesn't trigger a rebuild.
+const forwardedOps = fsnotify.Create | fsnotify.Write | fsnotify.Rename
+
+// handle reacts to a single fsnotify event: newly created directories
+// get their own watch, removed/renamed ones have theirs dropped. The
+// event is then forwarded on the Events channel if its op is one we
+// care about.
+func (w *Watcher) handle(ev fsnotify.Event) {
+	switch {
+	case ev.Op&fsnotify.Create == fsnotify.Create:
+		if info, err := os.Stat(ev.Name); err == nil && info.IsDir() {
+			w.addRecursive(ev.Name)
+		}
+	case ev.Op&(fsnotify.Remove|fsnotify.Rename) != 0:
+		w.fsw.Remove(ev.Name)
+	}
+
+	if ev.Op&forwardedOps == 0 {
+		return
+	}
+
+	w.events <- Event{Path: ev.Name, Op: ev.Op}
+}
+
+// addRecursive walks dir and adds a watch for every subdirectory that
+// isn't excluded, skipping excluded subtrees entirely.
+func (w *Watcher) addRecursive(dir string) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		if w.isExcluded(path) {
+			return filepath.SkipDir
+		}
+		return w.fsw.Add(path)
+	})
+}
+
+func (w *Watcher) isExcluded(path string) bool {
+	for _, re := range w.excluded {
+		if re.MatchString(path) {
+			return true
+		}
+	}
+	return false
+}
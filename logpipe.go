@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+
+	"github.com/fatih/color"
+)
+
+// tailSize is how many trailing lines a LogPipe keeps around so they can
+// be dumped if a quiet command turns out to have failed.
+const tailSize = 50
+
+// logPalette is the set of colors assigned to commands, cycled through
+// by name so that the same command keeps the same color across restarts.
+var logPalette = []color.Attribute{
+	color.FgCyan,
+	color.FgMagenta,
+	color.FgYellow,
+	color.FgGreen,
+	color.FgBlue,
+	color.FgRed,
+}
+
+// LogPipe wires a command's stdout/stderr through line-prefixing,
+// per-command coloring, optional log-file mirroring and, when quiet,
+// tail-buffering so failures are still visible.
+type LogPipe struct {
+	name    string
+	color   *color.Color
+	quiet   bool
+	logFile *os.File
+
+	mu   sync.Mutex
+	tail []string
+
+	wg sync.WaitGroup
+}
+
+// NewLogPipe creates a LogPipe for a command called name. logFile may be
+// nil to disable log-file mirroring.
+func NewLogPipe(name string, quiet bool, logFile *os.File) *LogPipe {
+	return &LogPipe{
+		name:    name,
+		color:   color.New(colorFor(name)),
+		quiet:   quiet,
+		logFile: logFile,
+	}
+}
+
+// colorFor deterministically picks a palette color for name, so the same
+// command is always printed in the same color.
+func colorFor(name string) color.Attribute {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	return logPalette[h.Sum32()%uint32(len(logPalette))]
+}
+
+// Attach wires cmd's stdout and stderr through the LogPipe. It must be
+// called before cmd.Start(). Callers must call Wait before cmd.Wait():
+// per the os/exec docs, Wait closes the pipes once the process exits,
+// so calling it before the pumps have finished draining them risks
+// losing the command's trailing output.
+func (lp *LogPipe) Attach(cmd *exec.Cmd) error {
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return err
+	}
+
+	lp.wg.Add(2)
+	go func() {
+		defer lp.wg.Done()
+		lp.pump(stdout)
+	}()
+	go func() {
+		defer lp.wg.Done()
+		lp.pump(stderr)
+	}()
+	return nil
+}
+
+// Wait blocks until both pump goroutines have drained their pipe (seen
+// EOF). Must be called before cmd.Wait().
+func (lp *LogPipe) Wait() {
+	lp.wg.Wait()
+}
+
+// pump scans r line by line, buffering, mirroring and (unless quiet)
+// printing each line as it arrives.
+func (lp *LogPipe) pump(r io.Reader) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		lp.mu.Lock()
+		lp.tail = append(lp.tail, line)
+		if len(lp.tail) > tailSize {
+			lp.tail = lp.tail[len(lp.tail)-tailSize:]
+		}
+		lp.mu.Unlock()
+
+		if lp.logFile != nil {
+			fmt.Fprintf(lp.logFile, "[%s] %s\n", lp.name, line)
+		}
+		if !lp.quiet {
+			fmt.Println(lp.color.Sprintf("[%s] %s", lp.name, line))
+		}
+	}
+}
+
+// DumpTail prints the buffered tail of output, used when a quiet command
+// exits non-zero and its output would otherwise have been suppressed.
+func (lp *LogPipe) DumpTail() {
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+	for _, line := range lp.tail {
+		fmt.Println(lp.color.Sprintf("[%s] %s", lp.name, line))
+	}
+}
+
+// openLogFile opens path for a fresh run: if a log from a previous run
+// exists, it's rotated to path+".1" (clobbering any older one) so each
+// run's log starts clean without losing the previous one entirely.
+// Returns nil, nil if path is empty.
+func openLogFile(path string) (*os.File, error) {
+	if path == "" {
+		return nil, nil
+	}
+	if _, err := os.Stat(path); err == nil {
+		os.Rename(path, path+".1")
+	}
+	return os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+}
@@ -1,97 +1,151 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"net/http"
 	"os"
 	"path/filepath"
 	"regexp"
 	"strings"
 	"time"
 
-	"github.com/radovskyb/watcher"
+	"github.com/opxyc/codmon/internal/livereload"
+	"github.com/opxyc/codmon/internal/watch"
 )
 
 func main() {
 	// Get config from json and command line flags
-	config, commands, attachStdin, verbose := get()
-	// if no commands are mentioned for execution after file modification, then
-	// gomon has nothing to do. Simply exit.
-	if commands == nil {
+	config, commands, blocks, runCfg, attachStdin, verbose := get()
+	// if no commands/blocks are mentioned for execution after file modification,
+	// then gomon has nothing to do. Simply exit.
+	if commands == nil && blocks == nil {
 		fmt.Fprintf(os.Stderr, "Usage: \n\t%s 'command1 [&& command ...]'\n\tUse --help for more\n", os.Args[0])
 		os.Exit(2)
 	}
 
+	// a flat command list (arguments, pipe or gomon.json "cmd") is just a single implicit block: every
+	// command but the last is a prep, the last one is the daemon.
+	if blocks == nil {
+		blocks = defaultBlocks(*commands)
+	}
+
+	// if -serve is given, start a live-reload websocket server and
+	// broadcast a reload message for every file change that matches a block
+	var broker *livereload.Broker
+	if runCfg.Serve != "" {
+		broker = livereload.NewBroker()
+		go func() {
+			if err := http.ListenAndServe(runCfg.Serve, broker.Handler()); err != nil {
+				fmt.Fprintf(os.Stderr, "[gomon] live-reload server stopped: %v\n", err)
+			}
+		}()
+		if *verbose {
+			fmt.Printf("[gomon] serving live-reload websocket on %s\n", runCfg.Serve)
+		}
+	}
+
 	// "job" entering the jobs channel is consumed by the "worker".
 	// What is a "job" and what does "worker" do?
-	// On every file update, the path of that file(which is returned by the Watcher) is sent to jobs channel.
-	// Upon receiving such a messsage, the worker will start executing the commands mentioned
-	// either in --cmd or in the json file.
-	// Before directly executing the command, the worker also makes sures to kill any process
-	// it has started before (when it received the previous file change message)
-	jobs := make(chan string)
-
-	w := watcher.New()
-	defer w.Close()
-	w.SetMaxEvents(1)
-
-	// Only notify rename, move, create and update events.
-	w.FilterOps(watcher.Rename, watcher.Move, watcher.Create, watcher.Write)
-	// Watch files that matches the given pattern
-	w.AddFilterHook(watcher.RegexFilterHook(config.Pattern, false))
-
-	// Watch this folder for changes.
-	if err := w.AddRecursive("."); err != nil {
+	// On every file update, the path(s) of the file(s) that changed are sent to the
+	// jobs channel for whichever blocks' watch pattern they match.
+	// Upon receiving such a message, the worker runs that block's prep commands in
+	// order and, if they all succeed, (re)starts its daemon command.
+	// Before directly restarting the daemon, the worker also makes sure to kill the
+	// one it started before (when it received the previous file change message).
+	jobs := make(chan job)
+
+	// Watch this folder for changes, registering a watch for every
+	// subdirectory except the ones excluded via config.
+	// config.ExcludedDirs holds absolute-path regexes (see
+	// formatDirPattern), so the watcher must walk an absolute root too,
+	// or its paths would never match them.
+	root, err := filepath.Abs(".")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to resolve working directory: %v\n", err)
+		os.Exit(2)
+	}
+	w, err := watch.New(root, &watch.Config{ExcludedDirs: config.ExcludedDirs})
+	if err != nil {
 		fmt.Fprintf(os.Stderr, "failed to watch for file change: %v\n", err)
 		os.Exit(2)
 	}
 
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
 	// watch for file changes
-	go watch(w, config, jobs)
+	go watchEvents(w, config, blocks, jobs, broker, runCfg.DebounceWindow)
 	// run the commands on file change
-	go worker(jobs, *commands, attachStdin, verbose)
+	go worker(jobs, blocks, runCfg, attachStdin, verbose)
 	// to run the commands on startup, send a message to the channel
 	// on receiving message, worker will start it's job
-	jobs <- "nothing"
+	for id := range blocks {
+		jobs <- job{BlockID: id}
+	}
 
 	// Start the watching process
-	if err := w.Start(time.Millisecond * 300); err != nil {
+	if err := w.Start(ctx); err != nil && ctx.Err() == nil {
 		fmt.Fprintf(os.Stderr, "failed to start watcher: %v\n", err)
 		os.Exit(2)
 	}
 }
 
-// watch watches for file changes
-// when it detects any change, it will sent a message to jobs channel
-func watch(w *watcher.Watcher, config *watcherConf, jobs chan<- string) {
-	// wait for send message to jobs channel since sometimes,
-	// user may press save multiple times so quickly
-	// which will make worker do unnecessary execution of commands
-	var prevMsgSent, currentTime time.Time
-	for {
-		select {
-		case event := <-w.Event:
-			if isItWorthIt(event.Path, config) {
-				currentTime = time.Now()
-				// if time difference < 1sec, dont bother
-				if !(currentTime.Sub(prevMsgSent) < time.Second*3) {
-					jobs <- event.Path
-					prevMsgSent = currentTime
-				}
+// defaultBlocks wraps a flat list of commands (from the arguments, a pipe, or the
+// json file's "cmd") into a single block named "default" that watches
+// everything the top-level config.Pattern already allows through.
+// ContinueOnPrepFailure is set so this block keeps the pre-blocks
+// behavior: every command in the list ran in order on every change,
+// regardless of exit code.
+func defaultBlocks(commands []string) map[string]block {
+	b := block{ID: "default", Pattern: regexp.MustCompile(`(.+\.*)$`), ContinueOnPrepFailure: true}
+	if len(commands) > 0 {
+		b.PrepCmds = commands[:len(commands)-1]
+		b.DaemonCmd = commands[len(commands)-1]
+	}
+	return map[string]block{"default": b}
+}
+
+// watchEvents watches for file changes.
+// when it detects any change, it records the changed path against every
+// block whose watch pattern matches it; a debouncer coalesces bursts of
+// such changes per block (e.g. an editor saving several files at once)
+// into a single job once that block has gone quiet for debounceWindow.
+// If a live-reload broker is configured, every matched change is also
+// teed out to it as a reload event, independent of debouncing.
+func watchEvents(w *watch.Watcher, config *watcherConf, blocks map[string]block, jobs chan<- job, broker *livereload.Broker, debounceWindow time.Duration) {
+	deb := newDebouncer(debounceWindow, jobs)
+	for event := range w.Events() {
+		if !isItWorthIt(event.Path, config) {
+			continue
+		}
+
+		base := filepath.Base(event.Path)
+		matched := false
+		for id, b := range blocks {
+			if b.Pattern.MatchString(base) {
+				deb.add(id, event.Path)
+				matched = true
 			}
-		case err := <-w.Error:
-			fmt.Println(err)
-			return
-		case <-w.Closed:
-			return
+		}
+
+		if matched && broker != nil {
+			broker.Publish(livereload.Event{Type: "reload", Path: event.Path})
 		}
 	}
 }
 
 // isItWorthIt checks if the file changed is worth running all the commands mentioned.
 // How does it decide the worth?
+// * if the file which was changed doesn't match the pattern to watch for, then it's not worthy
 // * if the directory in which the change occured is mentioned in "exclude.dirs", then it's not worthy
 // * if the file which was changed in mentioned in the "exclude.files", then it's not worthy
 func isItWorthIt(filePath string, config *watcherConf) bool {
+	base := filepath.Base(filePath)
+	if !config.Pattern.MatchString(base) {
+		return false
+	}
+
 	dir := filepath.Dir(filePath)
 	dir = strings.Replace(dir, "\\", "/", 99)
 	for _, d := range config.ExcludedDirs {
@@ -100,7 +154,6 @@ func isItWorthIt(filePath string, config *watcherConf) bool {
 		}
 	}
 
-	base := filepath.Base(filePath)
 	for _, f := range config.ExcludedFiles {
 		if matched, _ := regexp.MatchString(f, base); matched {
 			return false
@@ -2,103 +2,213 @@ package main
 
 import (
 	"fmt"
-	"io"
 	"os"
 	"os/exec"
 	"os/signal"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/fatih/color"
 )
 
-// hold the current subprocess details
-var currentProcess *os.Process
+// job is a unit of work sent to the worker: the id of the block to
+// (re)run, plus the paths of the files whose change triggered it (used
+// for "@mods" expansion in that block's commands).
+type job struct {
+	BlockID string
+	Paths   []string
+}
+
+// currentProcesses holds, per block id, the daemon process currently
+// running for that block (if any). Blocks run concurrently, each
+// (re)starting and killing its own daemon from its own goroutine, and
+// terminateCleanly ranges over it from yet another goroutine on
+// shutdown, so every access must go through currentProcessesMu.
+var currentProcesses = make(map[string]*os.Process)
+var currentProcessesMu sync.Mutex
 
-// for logging stdout and stderr of subprocess
-var pipeChan = make(chan io.ReadCloser)
+// blockLocks serializes dispatch per block id: two jobs for the same
+// block (e.g. the debouncer flushing again while the previous dispatch
+// is still mid-kill or mid-prep) must run their kill+prep+daemon-start
+// sequence one after another, never concurrently, or both can end up
+// starting a daemon and racing to own currentProcesses[id] - leaking
+// whichever one loses. Different blocks are unaffected by each other's
+// lock.
+var blockLocks = struct {
+	mu sync.Mutex
+	m  map[string]*sync.Mutex
+}{m: make(map[string]*sync.Mutex)}
 
-func worker(jobs <-chan string, commands []string, attachStdin *bool, verbose *bool) {
+// lockForBlock returns the mutex that serializes dispatch for a block
+// id, creating it on first use.
+func lockForBlock(id string) *sync.Mutex {
+	blockLocks.mu.Lock()
+	defer blockLocks.mu.Unlock()
+	mu, ok := blockLocks.m[id]
+	if !ok {
+		mu = &sync.Mutex{}
+		blockLocks.m[id] = mu
+	}
+	return mu
+}
+
+func worker(jobs <-chan job, blocks map[string]block, runCfg *execConf, attachStdin *bool, verbose *bool) {
 	// watch for any interrupts/kill commands
-	// if anything is received, kill the current running child process and exit
-	go terminateCleanly()
+	// if anything is received, kill all running daemons and exit
+	go terminateCleanly(runCfg.KillSignal, runCfg.KillTimeout)
 
-	okToExecute := make(chan bool)
-	go runCommands(commands, okToExecute, attachStdin, verbose)
+	logFile, err := openLogFile(runCfg.LogPath)
+	if err != nil && *verbose {
+		fmt.Printf("[gomon] Failed to open log file %s. Error: %v\n", runCfg.LogPath, err)
+	}
 
-	for {
-		// receive a job
-		<-jobs
-		// kill current running process
-		if currentProcess != nil {
-			pid := currentProcess.Pid
-			err := killProcess(currentProcess)
-			if err != nil && *verbose {
-				fmt.Printf("[gomon] Failed to kill process %d. Error: %v\n", pid, err)
-			} else if err == nil && *verbose {
-				fmt.Printf("[gomon] Killed process %d\n", pid)
-			}
+	for j := range jobs {
+		b, ok := blocks[j.BlockID]
+		if !ok {
+			continue
+		}
+
+		// dispatch kills the block's previous daemon (if any) and
+		// (re)starts it, all in its own goroutine: blocks run
+		// independently, so a slow-to-terminate daemon in one block
+		// must not stall dispatch of another block's jobs.
+		go dispatch(j, b, runCfg, logFile, attachStdin, verbose)
+	}
+}
+
+// dispatch kills the block's currently running daemon, if any, waits
+// for it to die, and then (re)starts the block via runBlock. It holds
+// that block's lock for the whole sequence, so a second dispatch for
+// the same block queues up instead of racing it.
+func dispatch(j job, b block, runCfg *execConf, logFile *os.File, attachStdin *bool, verbose *bool) {
+	mu := lockForBlock(j.BlockID)
+	mu.Lock()
+	defer mu.Unlock()
+
+	currentProcessesMu.Lock()
+	proc := currentProcesses[j.BlockID]
+	currentProcessesMu.Unlock()
+
+	if proc != nil {
+		pid := proc.Pid
+		err := killProcess(j.BlockID, proc, runCfg.KillSignal, runCfg.KillTimeout)
+		if err != nil && *verbose {
+			fmt.Printf("[gomon] Failed to kill process %d. Error: %v\n", pid, err)
+		} else if err == nil && *verbose {
+			fmt.Printf("[gomon] Killed process %d\n", pid)
 		}
 		// give a little pause so that if any process it killed,
 		// it's status is logged to console
 		time.Sleep(time.Millisecond * 1000)
-		// inform that current process is killed
-		okToExecute <- true
 	}
-}
 
-func runCommands(commands []string, okToExecute <-chan bool, attachStdin *bool, verbose *bool) {
-	for {
-		// wait for green signal
-		// this indicates that the previously created process is killed
-		// (so our program is not making orphaned processes)
-		<-okToExecute
-
-		// start running the commands
-		go func() {
-			for _, command := range commands {
-				fmt.Println(color.CyanString("> %s", command))
-				// start a new process
-				cmd, err := startCommand(command, attachStdin)
-				if err != nil {
-					fmt.Printf(color.RedString("[gomon] Failed to start. Error: %v\n", err))
-					continue
-				}
-
-				currentProcess = cmd.Process
-				// go writeResults(pipeChan)
-				if *verbose {
-					fmt.Printf("[gomon] Process %d created for executing '%s'\n", currentProcess.Pid, command)
-				}
+	runBlock(j.BlockID, b, j.Paths, runCfg.Quiet, logFile, attachStdin, verbose)
+}
 
-				// wait for it to finish
-				err = cmd.Wait()
+// runBlock runs a block's prep commands in order. Unless
+// b.ContinueOnPrepFailure is set, it stops at the first one that fails
+// and never (re)starts the daemon command; with it set, every prep
+// command runs regardless of exit code.
+func runBlock(id string, b block, paths []string, quiet bool, logFile *os.File, attachStdin *bool, verbose *bool) {
+	for _, prep := range b.PrepCmds {
+		command := expandMods(prep, paths)
+		fmt.Println(color.CyanString("> %s", command))
+		lp := NewLogPipe(id, quiet, logFile)
+		cmd, err := startCommand(command, attachStdin, lp)
+		if err != nil {
+			fmt.Printf(color.RedString("[gomon] Failed to start. Error: %v\n", err))
+			if b.ContinueOnPrepFailure {
+				continue
+			}
+			return
+		}
+		lp.Wait()
+		err = cmd.Wait()
+		if err != nil && quiet {
+			lp.DumpTail()
+		}
+		if err != nil {
+			if b.ContinueOnPrepFailure {
 				if *verbose {
-					if err != nil {
-						if currentProcess != nil {
-							fmt.Printf("[gomon] Process %d terminated with error or was killed. Error: %v\n", cmd.Process.Pid, err)
-							currentProcess = nil
-						}
-					} else {
-						fmt.Printf("[gomon] Process %d completed successfully\n", cmd.Process.Pid)
-					}
+					fmt.Printf("[gomon] prep '%s' failed, continuing. Error: %v\n", command, err)
 				}
+				continue
+			}
+			if *verbose {
+				fmt.Printf("[gomon] prep '%s' failed, not (re)starting daemon. Error: %v\n", command, err)
 			}
 			return
-		}()
+		}
 	}
+
+	if b.DaemonCmd == "" {
+		return
+	}
+
+	command := expandMods(b.DaemonCmd, paths)
+	fmt.Println(color.CyanString("> %s", command))
+	lp := NewLogPipe(id, quiet, logFile)
+	cmd, err := startCommand(command, attachStdin, lp)
+	if err != nil {
+		fmt.Printf(color.RedString("[gomon] Failed to start. Error: %v\n", err))
+		return
+	}
+
+	currentProcessesMu.Lock()
+	currentProcesses[id] = cmd.Process
+	currentProcessesMu.Unlock()
+	if *verbose {
+		fmt.Printf("[gomon] Process %d created for executing '%s'\n", cmd.Process.Pid, command)
+	}
+
+	// wait for it to finish in the background, so that runBlock (and the
+	// caller's block lock) returns as soon as the daemon has started
+	go func() {
+		lp.Wait()
+		err := cmd.Wait()
+		if err != nil && quiet {
+			lp.DumpTail()
+		}
+		if *verbose {
+			if err != nil {
+				fmt.Printf("[gomon] Process %d terminated with error or was killed. Error: %v\n", cmd.Process.Pid, err)
+			} else {
+				fmt.Printf("[gomon] Process %d completed successfully\n", cmd.Process.Pid)
+			}
+		}
+		currentProcessesMu.Lock()
+		if currentProcesses[id] == cmd.Process {
+			currentProcesses[id] = nil
+		}
+		currentProcessesMu.Unlock()
+	}()
 }
 
-// creates a child process and try to get it's stdout and stderr pipes
-func startCommand(command string, attachStdin *bool) (*exec.Cmd, error) {
+// expandMods substitutes "@mods" in command with the space-separated
+// list of changed file paths that triggered the job.
+func expandMods(command string, paths []string) string {
+	if !strings.Contains(command, "@mods") {
+		return command
+	}
+	return strings.ReplaceAll(command, "@mods", strings.Join(paths, " "))
+}
+
+// creates a child process and wires its stdout/stderr through lp. The
+// child is put in its own process group so that killProcess can signal
+// it (and anything it has spawned) as a unit.
+func startCommand(command string, attachStdin *bool, lp *LogPipe) (*exec.Cmd, error) {
 	args := strings.Split(command, " ")
 	cmd := exec.Command(args[0], args[1:]...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
 	if *attachStdin {
 		cmd.Stdin = os.Stdin
 	}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	if err := lp.Attach(cmd); err != nil {
+		return nil, err
+	}
 
 	if err := cmd.Start(); err != nil {
 		return nil, err
@@ -107,19 +217,42 @@ func startCommand(command string, attachStdin *bool) (*exec.Cmd, error) {
 	return cmd, nil
 }
 
-// killProcess kills a process(hard kill)
-func killProcess(process *os.Process) error {
-	err := process.Kill()
-	if err != nil {
+// killProcess stops a block's daemon gracefully: it sends killSignal to
+// the daemon's whole process group, waits up to killTimeout for it to
+// exit, and only escalates to SIGKILL if it hasn't by then.
+func killProcess(id string, process *os.Process, killSignal syscall.Signal, killTimeout time.Duration) error {
+	pgid := -process.Pid
+	if err := syscall.Kill(pgid, killSignal); err != nil {
 		return err
 	}
-	currentProcess = nil
-	return nil
+
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	deadline := time.After(killTimeout)
+	for {
+		select {
+		case <-deadline:
+			syscall.Kill(pgid, syscall.SIGKILL)
+			currentProcessesMu.Lock()
+			currentProcesses[id] = nil
+			currentProcessesMu.Unlock()
+			return nil
+		case <-ticker.C:
+			// signal 0 doesn't actually signal anything, it just checks
+			// whether the process (group leader) is still alive
+			if process.Signal(syscall.Signal(0)) != nil {
+				currentProcessesMu.Lock()
+				currentProcesses[id] = nil
+				currentProcessesMu.Unlock()
+				return nil
+			}
+		}
+	}
 }
 
-// terminateCleanly listens for interrupts and try to kill currently
-// running subprocess before exiting.
-func terminateCleanly() {
+// terminateCleanly listens for interrupts and try to kill all currently
+// running daemon processes before exiting.
+func terminateCleanly(killSignal syscall.Signal, killTimeout time.Duration) {
 	var fatalSignals = []os.Signal{
 		syscall.SIGINT,
 		syscall.SIGTERM,
@@ -131,8 +264,17 @@ func terminateCleanly() {
 	<-signalChan
 
 	fmt.Println(color.CyanString("Exiting.."))
-	if currentProcess != nil {
-		killProcess(currentProcess)
+	currentProcessesMu.Lock()
+	processes := make(map[string]*os.Process, len(currentProcesses))
+	for id, process := range currentProcesses {
+		processes[id] = process
+	}
+	currentProcessesMu.Unlock()
+
+	for id, process := range processes {
+		if process != nil {
+			killProcess(id, process, killSignal, killTimeout)
+		}
 	}
 	os.Exit(0)
 }